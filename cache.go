@@ -0,0 +1,127 @@
+/*
+ * Copyright 2015 Édouard Hue
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ * DiskCache is a small cache-aside store for SPARQL and Commons responses,
+ * so that repeated runs against the same CSV -- the common case while
+ * iterating on templates -- don't re-hit the APIs. Entries are gzip-
+ * compressed JSON, keyed by a hash of whatever identifies the request
+ * (URL, query body, category name...), stored under -cache-dir.
+ */
+type DiskCache struct {
+	dir string
+}
+
+// NewDiskCache returns nil, a no-op cache, when dir is empty.
+func NewDiskCache(dir string) *DiskCache {
+	if dir == "" {
+		return nil
+	}
+	check(os.MkdirAll(dir, 0755))
+	return &DiskCache{dir: dir}
+}
+
+// cacheKey hashes the given parts into a stable, filesystem-safe cache key.
+func cacheKey(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		io.WriteString(h, p)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type cacheRecord struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Body      json.RawMessage `json:"body"`
+}
+
+func (c *DiskCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json.gz")
+}
+
+// Get looks up key and, if present and younger than ttl, decodes its body
+// into out and returns true. It always misses when the cache is disabled or
+// -cache-bypass was passed.
+func (c *DiskCache) Get(key string, ttl time.Duration, out interface{}) bool {
+	if c == nil || cacheBypass {
+		return false
+	}
+
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return false
+	}
+	defer gz.Close()
+
+	var record cacheRecord
+	if err := json.NewDecoder(gz).Decode(&record); err != nil {
+		return false
+	}
+	if time.Since(record.Timestamp) > ttl {
+		return false
+	}
+
+	return json.Unmarshal(record.Body, out) == nil
+}
+
+// Put stores value under key with the current time, overwriting any
+// previous entry.
+func (c *DiskCache) Put(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+
+	body, err := json.Marshal(value)
+	check(err)
+
+	f, err := os.Create(c.path(key))
+	check(err)
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	defer gz.Close()
+
+	check(json.NewEncoder(gz).Encode(cacheRecord{Timestamp: time.Now(), Body: body}))
+}
+
+// Invalidate drops a single entry, e.g. once a page edit referencing it has
+// succeeded, so the next run sees fresh file counts.
+func (c *DiskCache) Invalidate(key string) {
+	if c == nil {
+		return
+	}
+	os.Remove(c.path(key))
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2015 Édouard Hue
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiskCacheRoundTrip(t *testing.T) {
+	c := NewDiskCache(t.TempDir())
+
+	c.Put("key", categoryInfo{Files: 3, SubCats: 1, SubCatsFiles: 2})
+
+	var got categoryInfo
+	if !c.Get("key", time.Hour, &got) {
+		t.Fatal("expected a cache hit right after Put")
+	}
+	if got != (categoryInfo{Files: 3, SubCats: 1, SubCatsFiles: 2}) {
+		t.Fatalf("got %+v, want Files=3 SubCats=1 SubCatsFiles=2", got)
+	}
+}
+
+func TestDiskCacheMissOnExpiry(t *testing.T) {
+	c := NewDiskCache(t.TempDir())
+	c.Put("key", categoryInfo{Files: 1})
+
+	var got categoryInfo
+	if c.Get("key", 0, &got) {
+		t.Fatal("expected a miss once the entry is older than ttl")
+	}
+}
+
+func TestDiskCacheMissOnUnknownKey(t *testing.T) {
+	c := NewDiskCache(t.TempDir())
+
+	var got categoryInfo
+	if c.Get("missing", time.Hour, &got) {
+		t.Fatal("expected a miss for a key that was never put")
+	}
+}
+
+func TestDiskCacheInvalidate(t *testing.T) {
+	c := NewDiskCache(t.TempDir())
+	c.Put("key", categoryInfo{Files: 1})
+	c.Invalidate("key")
+
+	var got categoryInfo
+	if c.Get("key", time.Hour, &got) {
+		t.Fatal("expected a miss after Invalidate")
+	}
+}
+
+func TestDiskCacheDisabled(t *testing.T) {
+	var c *DiskCache
+
+	var got categoryInfo
+	if c.Get("key", time.Hour, &got) {
+		t.Fatal("a nil cache should never report a hit")
+	}
+	// Put/Invalidate on a nil cache must be no-ops, not panics.
+	c.Put("key", categoryInfo{Files: 1})
+	c.Invalidate("key")
+}
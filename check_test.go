@@ -0,0 +1,84 @@
+/*
+ * Copyright 2015 Édouard Hue
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestCheckPanicsUnderServe verifies check()'s -serve branch: with serveAddr
+// set, an error panics instead of calling log.Fatal, which is what lets
+// refreshCatalogLoop recover from it instead of the whole process exiting.
+func TestCheckPanicsUnderServe(t *testing.T) {
+	old := serveAddr
+	serveAddr = ":8080"
+	defer func() { serveAddr = old }()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected check() to panic under -serve")
+		}
+	}()
+	check(errors.New("boom"))
+}
+
+// TestCheckNoopOnNilError verifies check() does nothing, in either mode,
+// when there is nothing to report.
+func TestCheckNoopOnNilError(t *testing.T) {
+	old := serveAddr
+	serveAddr = ":8080"
+	defer func() { serveAddr = old }()
+
+	check(nil)
+
+	serveAddr = ""
+	check(nil)
+}
+
+// TestRecoverStageRecordsCheckPanic exercises the combination
+// refreshCatalogOnce relies on: a goroutine that calls check() under
+// -serve, wrapped in recoverStage, must turn that panic into a recorded
+// error instead of crashing the test binary.
+func TestRecoverStageRecordsCheckPanic(t *testing.T) {
+	old := serveAddr
+	serveAddr = ":8080"
+	defer func() { serveAddr = old }()
+
+	errs := &firstError{}
+	func() {
+		defer recoverStage(errs)
+		check(errors.New("sparql endpoint unreachable"))
+	}()
+
+	if err := errs.get(); err == nil || err.Error() != "sparql endpoint unreachable" {
+		t.Fatalf("got error %v, want \"sparql endpoint unreachable\"", err)
+	}
+}
+
+// TestFirstErrorKeepsEarliest checks firstError.set discards later errors
+// once one has been recorded, so a pipeline run surfaces the failure that
+// actually started the cascade.
+func TestFirstErrorKeepsEarliest(t *testing.T) {
+	errs := &firstError{}
+	errs.set(errors.New("first"))
+	errs.set(errors.New("second"))
+
+	if got := errs.get(); got == nil || got.Error() != "first" {
+		t.Fatalf("got %v, want \"first\"", got)
+	}
+}
@@ -23,15 +23,20 @@ import (
 	"cgt.name/pkg/go-mwclient/params"
 	"encoding/csv"
 	"flag"
+	"fmt"
+	"github.com/edouardhue/collections/wikitext"
 	"github.com/jmcvetta/napping"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
 /*
@@ -44,8 +49,16 @@ const COMMONS_API_URL = "https://commons.wikimedia.org/w/api.php"
 
 const WDQ_API_URL = "https://wdq.wmflabs.org/api"
 
+const SPARQL_API_URL = "https://query.wikidata.org/sparql"
+
+const SPARQL_ACCEPT_HEADER = "application/sparql-results+json"
+
+const WIKIDATA_ENTITY_PREFIX = "http://www.wikidata.org/entity/Q"
+
 const COMMONS_CAT_PROPERTY = "373"
 
+const SPARQL_BATCH_SIZE = 200
+
 const CATEGORY_NAMESPACE = "Category:"
 
 /*
@@ -88,14 +101,33 @@ type wdqQuery struct {
 	props string
 }
 
+/*
+ * Structures for Wikidata SPARQL interaction
+ */
+
+type sparqlBindingValue struct {
+	Value string `json:"value"`
+}
+
+type sparqlBinding struct {
+	Item       sparqlBindingValue `json:"item"`
+	CommonsCat sparqlBindingValue `json:"commonsCat"`
+}
+
+type sparqlResult struct {
+	Results struct {
+		Bindings []sparqlBinding `json:"bindings"`
+	} `json:"results"`
+}
+
 /*
  * Intermediary structure for Commons interaction
  */
 
 type categoryInfo struct {
-	files        int
-	subCats      int
-	subCatsFiles int
+	Files        int `json:"files"`
+	SubCats      int `json:"subCats"`
+	SubCatsFiles int `json:"subCatsFiles"`
 }
 
 /*
@@ -107,13 +139,38 @@ var templateLocation string
 var wikiApiUrl string
 var pageTitle string
 var sectionNumber string
+var sectionAnchor string
+var wdqCompat bool
+var forceReplace bool
+var cacheDirFlag string
+var sparqlCacheTTL time.Duration
+var commonsCacheTTL time.Duration
+var cacheBypass bool
+var rateLimitQps float64
+var batchSize int
+var sparqlWorkers int
+var commonsWorkers int
+var progressEvery int
+var serveAddr string
+var refreshInterval time.Duration
 
 var commons, wiki *mwclient.Client
-
+var diskCache *DiskCache
+var limiter *tokenBucket
+
+// check reports an unrecoverable error. In the one-shot wiki-editing flow
+// that means exiting right away; but under -serve, refreshCatalogLoop
+// recovers from a failed pass so a transient network/decode error doesn't
+// take the whole server down with it, so check panics there instead of
+// calling log.Fatal, which a deferred recover can't catch.
 func check(e error) {
-	if e != nil {
-		log.Fatal(e)
+	if e == nil {
+		return
+	}
+	if serveAddr != "" {
+		panic(e)
 	}
+	log.Fatal(e)
 }
 
 func initFlags() *flag.FlagSet {
@@ -123,7 +180,21 @@ func initFlags() *flag.FlagSet {
 	set.StringVar(&wikiApiUrl, "w", "", "Wiki API URL.")
 	set.StringVar(&pageTitle, "p", "", "Page title.")
 	set.StringVar(&sectionNumber, "s", "", "Section number.")
-	
+	set.StringVar(&sectionAnchor, "section-anchor", "", "Heading text identifying the target section; overrides -s when set.")
+	set.BoolVar(&wdqCompat, "wdq-compat", false, "Query the decommissioned WDQ API instead of Wikidata SPARQL (for local testing only).")
+	set.BoolVar(&forceReplace, "force-replace", false, "Overwrite the whole section instead of reconciling it with the existing wikitext.")
+	set.StringVar(&cacheDirFlag, "cache-dir", "", "Directory for the on-disk SPARQL/Commons response cache (disabled when empty).")
+	set.DurationVar(&sparqlCacheTTL, "cache-ttl", 24*time.Hour, "Cache TTL for SPARQL responses.")
+	set.DurationVar(&commonsCacheTTL, "commons-cache-ttl", time.Hour, "Cache TTL for Commons categoryinfo responses.")
+	set.BoolVar(&cacheBypass, "cache-bypass", false, "Ignore cached responses for this run, but still refresh the cache with what's fetched.")
+	set.Float64Var(&rateLimitQps, "qps", 5, "Maximum number of cache-missing requests per second against Commons/WDQS.")
+	set.IntVar(&batchSize, "batch-size", 200, "Number of Wikidata IDs accumulated per pipeline batch.")
+	set.IntVar(&sparqlWorkers, "sparql-workers", 4, "Number of concurrent workers resolving batches against SPARQL/WDQ.")
+	set.IntVar(&commonsWorkers, "commons-workers", 4, "Number of concurrent workers looking up Commons file counts.")
+	set.IntVar(&progressEvery, "progress-every", 100, "Log pipeline progress every N specimens processed (0 disables it).")
+	set.StringVar(&serveAddr, "serve", "", "Instead of editing the wiki, serve the reconciled catalog as JSON/HTML on this address (e.g. :8080).")
+	set.DurationVar(&refreshInterval, "refresh-interval", 15*time.Minute, "How often -serve re-reads the catalog and refreshes Commons/SPARQL data.")
+
 	return set
 }
 
@@ -131,11 +202,19 @@ func main() {
 	flags := initFlags()
 	check(flags.Parse(os.Args[1:]))
 
+	diskCache = NewDiskCache(cacheDirFlag)
+	limiter = newTokenBucket(rateLimitQps)
+
 	// Anonymous connection to Commons
 	var commonsErr error
 	commons, commonsErr = mwclient.New(COMMONS_API_URL, APP_VERSION)
 	check(commonsErr)
 
+	if serveAddr != "" {
+		serveCatalog()
+		return
+	}
+
 	// Authenticated connection to the target wiki
 	var wikiErr error
 	wiki, wikiErr = mwclient.New(wikiApiUrl, APP_VERSION)
@@ -149,8 +228,9 @@ func main() {
 	err := wiki.Login(login, password)
 	check(err)
 
-	// Open specimens channel
-	specimens := make(chan specimen)
+	// Open a buffered specimens channel so the CSV reader can run ahead of
+	// the batcher instead of blocking on it row by row.
+	specimens := make(chan specimen, batchSize)
 
 	// Read specimens
 	go readCsvFile(specimens)
@@ -170,9 +250,9 @@ func main() {
 
 // Read main CSV file and build incomplete items from it
 func readCsvFile(specimens chan specimen) {
-	
+
 	log.Printf("Opening catalog file %s\n", csvLocation)
-	
+
 	f, err := os.Open(csvLocation)
 	check(err)
 	defer f.Close()
@@ -201,133 +281,447 @@ func readCsvFile(specimens chan specimen) {
 
 		specimens <- specimen
 	}
-	
+
 	log.Println("Done reading catalog")
 }
 
+// BATCH_FLUSH_INTERVAL bounds how long a partial batch waits for more rows
+// before being sent down the pipeline anyway, so the last rows of a CSV
+// don't stall behind a batch that will never fill up.
+const BATCH_FLUSH_INTERVAL = 5 * time.Second
+
+// resolvedBatch is a batch of specimens once their Commons category names
+// have been resolved, together with the distinct category names to look up
+// on Commons.
+type resolvedBatch struct {
+	specimens     []specimen
+	categoryNames []string
+}
+
 /*
- * Buffer all item IDs,
- *  then query WDQ for Category names (P373),
- *  then query Commons for file counts,
- *  then merge information into items,
- *  then generate target wiki page and publish it.
+ * Stream specimens through a bounded pipeline instead of buffering the whole
+ * catalog in memory: a batcher groups rows off `specimens` into batches of
+ * up to -batch-size, a pool of -sparql-workers resolves each batch's Commons
+ * category names, a pool of -commons-workers looks up their file counts
+ * (expanding subcategories as needed), and updateWikiPage inserts specimens
+ * into a sorted slice as they arrive, then edits the page once the pipeline
+ * has drained.
  */
 func queryWdq(specimens chan specimen, c chan int) {
-	// We will need to retrieve items from their Wikidata item id.
-	// We might have several items for the same Wikidata item.
-	specimensByWikidataId := make(map[string][]specimen)
-	// We will also need to retrieve categories by their name
-	categoryInfo := make(map[string]categoryInfo)
+	merged, _ := runPipeline(specimens)
+	go updateWikiPage(logProgress(merged, progressEvery), c)
+}
 
-	// Join all Wikidata item ids and build a lookup map in the same loop
+// firstError keeps the first non-nil error reported to it by set, so a
+// pipeline run surfaces its earliest failure instead of whichever happened
+// to be reported last.
+type firstError struct {
+	mutex sync.Mutex
+	err   error
+}
+
+func (f *firstError) set(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *firstError) get() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.err
+}
+
+// recoverStage turns a panic in a pipeline worker goroutine -- notably
+// check()'s under -serve -- into a recorded error instead of letting it
+// escape the goroutine and crash the whole process, so refreshCatalogOnce
+// can report a failed pass instead of taking -serve down with it.
+func recoverStage(errs *firstError) {
+	if r := recover(); r != nil {
+		errs.set(fmt.Errorf("%v", r))
+	}
+}
+
+// runPipeline wires the batch/SPARQL/Commons stages over specimens and
+// returns a channel of enriched specimens, closed once every batch has
+// flowed all the way through, together with the first error any stage
+// recovered from along the way (nil if none did). Shared by the
+// wiki-editing flow and the catalog server's refresh loop.
+func runPipeline(specimens chan specimen) (chan specimen, *firstError) {
+	errs := &firstError{}
+
+	batches := make(chan []specimen, sparqlWorkers)
+	resolved := make(chan resolvedBatch, commonsWorkers)
+	merged := make(chan specimen, batchSize)
+
+	go func() {
+		defer recoverStage(errs)
+		batchSpecimens(specimens, batches)
+	}()
+
+	var sparqlWg sync.WaitGroup
+	sparqlWg.Add(sparqlWorkers)
+	for i := 0; i < sparqlWorkers; i++ {
+		go func() {
+			defer sparqlWg.Done()
+			defer recoverStage(errs)
+			for batch := range batches {
+				resolved <- resolveBatch(batch)
+			}
+		}()
+	}
+	go func() {
+		sparqlWg.Wait()
+		close(resolved)
+	}()
+
+	var commonsWg sync.WaitGroup
+	commonsWg.Add(commonsWorkers)
+	for i := 0; i < commonsWorkers; i++ {
+		go func() {
+			defer commonsWg.Done()
+			defer recoverStage(errs)
+			for rb := range resolved {
+				enrichBatch(rb, merged)
+			}
+		}()
+	}
+	go func() {
+		commonsWg.Wait()
+		close(merged)
+	}()
+
+	return merged, errs
+}
+
+// batchSpecimens accumulates rows off in into batches of up to batchSize,
+// flushing early every BATCH_FLUSH_INTERVAL so a slow trickle of rows still
+// makes progress down the pipeline.
+func batchSpecimens(in chan specimen, out chan []specimen) {
+	defer close(out)
+
+	ticker := time.NewTicker(BATCH_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	var buf []specimen
+	flush := func() {
+		if len(buf) > 0 {
+			out <- buf
+			buf = nil
+		}
+	}
+
+	for {
+		select {
+		case s, ok := <-in:
+			if !ok {
+				flush()
+				return
+			}
+			buf = append(buf, s)
+			if len(buf) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// resolveBatch looks up the Commons category name for every specimen in
+// batch, either via the legacy WDQ API or, by default, Wikidata's SPARQL
+// endpoint.
+func resolveBatch(batch []specimen) resolvedBatch {
+	specimensByWikidataId := make(map[string][]specimen)
 	var wikidataIds []string
-	for i := range specimens {
-		wikidataId := strings.TrimPrefix(i.WikidataItemId, "Q")
+	for _, s := range batch {
+		wikidataId := strings.TrimPrefix(s.WikidataItemId, "Q")
 		wikidataIds = append(wikidataIds, wikidataId)
-		specimensByWikidataId[wikidataId] = append(specimensByWikidataId[wikidataId], i)
+		specimensByWikidataId[wikidataId] = append(specimensByWikidataId[wikidataId], s)
+	}
+
+	var categoryNames []string
+	if wdqCompat {
+		categoryNames = lookupCommonsCategoriesWdq(wikidataIds, specimensByWikidataId)
+	} else {
+		categoryNames = lookupCommonsCategoriesSparql(wikidataIds, specimensByWikidataId)
+	}
+
+	var resolvedSpecimens []specimen
+	for _, itemSpecimens := range specimensByWikidataId {
+		resolvedSpecimens = append(resolvedSpecimens, itemSpecimens...)
 	}
 
+	return resolvedBatch{specimens: resolvedSpecimens, categoryNames: categoryNames}
+}
+
+// enrichBatch looks up Commons file counts for rb's category names and
+// writes each enriched specimen to out. The lookup itself is split into
+// sub-chunks of 50 category names (Commons' own titles-per-request limit),
+// resolved by a pool of commonsWorkers so -commons-workers actually bounds
+// how many Commons requests a single batch can have in flight at once.
+func enrichBatch(rb resolvedBatch, out chan specimen) {
+	categoryInfoMap := make(map[string]categoryInfo)
+	var categoryInfoMutex sync.Mutex
+
+	chunks := make(chan []string)
+	go func() {
+		defer close(chunks)
+		for i := 0; i < len(rb.categoryNames); i += 50 {
+			end := i + 50
+			if end > len(rb.categoryNames) {
+				end = len(rb.categoryNames)
+			}
+			chunks <- rb.categoryNames[i:end]
+		}
+	}()
+
+	workers := commonsWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for names := range chunks {
+				queryCommons(categoryInfoMap, names, &categoryInfoMutex)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, s := range rb.specimens {
+		thisCategoryInfo := categoryInfoMap[s.CommonsCategoryName]
+
+		s.FileCount = thisCategoryInfo.Files
+		s.SubCats = thisCategoryInfo.SubCats
+		s.SubCatsFileCounts = thisCategoryInfo.SubCatsFiles
+		s.TotalFiles = s.FileCount + s.SubCatsFileCounts
+
+		out <- s
+	}
+}
+
+// logProgress forwards every specimen from in to the returned channel,
+// logging every progressEvery items so long runs show signs of life.
+func logProgress(in chan specimen, every int) chan specimen {
+	out := make(chan specimen)
+	go func() {
+		defer close(out)
+		count := 0
+		for s := range in {
+			count++
+			if every > 0 && count%every == 0 {
+				log.Printf("Pipeline progress: %d specimens processed\n", count)
+			}
+			out <- s
+		}
+		log.Printf("Pipeline progress: %d specimens processed (done)\n", count)
+	}()
+	return out
+}
+
+/*
+ * Query the legacy WDQ API for every item's Commons category name (P373) in
+ * one shot. wdq.wmflabs.org has been decommissioned for years; this is kept
+ * only behind -wdq-compat for local testing against a mock.
+ */
+func lookupCommonsCategoriesWdq(wikidataIds []string, specimensByWikidataId map[string][]specimen) []string {
 	query := napping.Params{
 		"q":     "ITEMS[" + strings.Join(wikidataIds, ",") + "]",
 		"props": COMMONS_CAT_PROPERTY,
 	}
 	result := wdqResult{}
 
-	// Query WDQ
 	log.Printf("Querying WDQ with params %s\n", &query)
 	resp, err := napping.Get(WDQ_API_URL, &query, &result, nil)
 	check(err)
 
-	if resp.Status() == 200 {
-		if result.Status.Error != "OK" {
-			panic(result.Status.Error)
+	if resp.Status() != 200 {
+		panic(resp.Status)
+	}
+	if result.Status.Error != "OK" {
+		panic(result.Status.Error)
+	}
+
+	log.Println("Handling answer from WDQ")
+
+	var categoryNames []string
+	for _, itemProp := range result.Props[COMMONS_CAT_PROPERTY] {
+		itemId := int(itemProp[0].(float64))
+		categoryName := CATEGORY_NAMESPACE + itemProp[2].(string)
+
+		itemSpecimens := specimensByWikidataId[strconv.Itoa(itemId)]
+		for i, specimen := range itemSpecimens {
+			specimen.CommonsCategoryName = categoryName
+			itemSpecimens[i] = specimen
 		}
 
-		log.Println("Handling answer from WDQ")
-
-		// We build an array of all Commons category names, then slice it up in multiple Commons queries.
-		var categoryNames []string
-		// For Commons queries synchronisation
-		var commonsQueries []chan int
-
-		// Position in categoryNames
-		cursor := 0
-		// Loop on WDQ result
-		for i, itemProp := range result.Props[COMMONS_CAT_PROPERTY] {
-			itemId := int(itemProp[0].(float64))
-			categoryName := itemProp[2].(string)
-
-			// Set specimens Commons category name
-			itemSpecimens := specimensByWikidataId[strconv.Itoa(itemId)]
-			for i, specimen := range itemSpecimens {
-				specimen.CommonsCategoryName = CATEGORY_NAMESPACE + categoryName
-				itemSpecimens[i] = specimen
+		categoryNames = append(categoryNames, categoryName)
+	}
+
+	return categoryNames
+}
+
+/*
+ * Resolve every item's Commons category name (P373) from Wikidata's SPARQL
+ * endpoint. The VALUES clause gets large quickly, so the ids are split into
+ * batches of SPARQL_BATCH_SIZE and resolved by a pool of sparqlWorkers that
+ * write into specimensByWikidataId, guarded by a mutex -- so -sparql-workers
+ * also bounds how many SPARQL requests a single resolveBatch call can have
+ * in flight at once.
+ */
+func lookupCommonsCategoriesSparql(wikidataIds []string, specimensByWikidataId map[string][]specimen) []string {
+	var categoryNames []string
+	var mutex sync.Mutex
+
+	batches := make(chan []string)
+	go func() {
+		defer close(batches)
+		for i := 0; i < len(wikidataIds); i += SPARQL_BATCH_SIZE {
+			end := i + SPARQL_BATCH_SIZE
+			if end > len(wikidataIds) {
+				end = len(wikidataIds)
 			}
+			batches <- wikidataIds[i:end]
+		}
+	}()
 
-			// Accumulate Commons category names and query when reaching API limit
-			categoryNames = append(categoryNames, CATEGORY_NAMESPACE+categoryName)
-			if i > 0 && i%50 == 0 {
-				cursor = i
-				q := make(chan int)
-				commonsQueries = append(commonsQueries, q)
-				go queryCommons(categoryInfo, categoryNames[i-50:i], q)
+	workers := sparqlWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				names := querySparql(batch, specimensByWikidataId, &mutex)
+
+				mutex.Lock()
+				categoryNames = append(categoryNames, names...)
+				mutex.Unlock()
 			}
+		}()
+	}
+
+	wg.Wait()
+	return categoryNames
+}
+
+/*
+ * Run a single SPARQL query for a batch of Wikidata item ids, write each
+ * resolved item's Commons category name back into specimensByWikidataId and
+ * return the list of category names found.
+ */
+func querySparql(wikidataIds []string, specimensByWikidataId map[string][]specimen, mutex *sync.Mutex) []string {
+	var values []string
+	for _, id := range wikidataIds {
+		values = append(values, "wd:Q"+id)
+	}
+	queryString := "SELECT ?item ?commonsCat WHERE { VALUES ?item { " + strings.Join(values, " ") +
+		" } ?item wdt:P" + COMMONS_CAT_PROPERTY + " ?commonsCat. }"
+
+	result := sparqlResult{}
+	key := cacheKey("sparql", queryString)
+
+	if !diskCache.Get(key, sparqlCacheTTL, &result) {
+		query := napping.Params{
+			"query":  queryString,
+			"format": "json",
 		}
-		// Make the last query with remaining categories
-		q := make(chan int)
-		commonsQueries = append(commonsQueries, q)
-		go queryCommons(categoryInfo, categoryNames[cursor:], q)
-
-		// Wait for queries to terminate
-		for _, q := range commonsQueries {
-			<-q
+
+		session := napping.Session{
+			Header: &http.Header{
+				"Accept":     []string{SPARQL_ACCEPT_HEADER},
+				"User-Agent": []string{APP_VERSION},
+			},
 		}
-	} else {
-		panic(resp.Status)
-	}
 
-	// Now we can update specimens with Commons information
-	updatedSpecimens := make(chan specimen)
-	defer close(updatedSpecimens)
+		limiter.wait()
 
-	// Start page update routine
-	go updateWikiPage(updatedSpecimens, c)
+		log.Printf("Querying Wikidata SPARQL endpoint for %d items\n", len(wikidataIds))
+		resp, err := session.Get(SPARQL_API_URL, &query, &result, nil)
+		check(err)
 
-	for _, itemSpecimens := range specimensByWikidataId {
-		for _, specimen := range itemSpecimens {
-			// Lookup category information
-			thisCategoryInfo := categoryInfo[specimen.CommonsCategoryName]
-
-			// Update specimen
-			specimen.FileCount = thisCategoryInfo.files
-			specimen.SubCats = thisCategoryInfo.subCats
-			specimen.SubCatsFileCounts = thisCategoryInfo.subCatsFiles
-			specimen.TotalFiles = specimen.FileCount + specimen.SubCatsFileCounts
-
-			// Send it to page update routine
-			updatedSpecimens <- specimen
+		if resp.Status() != 200 {
+			panic(resp.Status)
+		}
+
+		diskCache.Put(key, result)
+	}
+
+	var categoryNames []string
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, binding := range result.Results.Bindings {
+		itemId := strings.TrimPrefix(binding.Item.Value, WIKIDATA_ENTITY_PREFIX)
+		categoryName := CATEGORY_NAMESPACE + binding.CommonsCat.Value
+
+		itemSpecimens := specimensByWikidataId[itemId]
+		for i, specimen := range itemSpecimens {
+			specimen.CommonsCategoryName = categoryName
+			itemSpecimens[i] = specimen
 		}
+
+		categoryNames = append(categoryNames, categoryName)
 	}
 
+	return categoryNames
+}
+
+// getCategoryInfo and setCategoryInfo are the only way queryCommons's
+// goroutines touch categoryMembers, so that map is never read or written
+// without mutex held.
+func getCategoryInfo(categoryMembers map[string]categoryInfo, mutex *sync.Mutex, title string) categoryInfo {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return categoryMembers[title]
+}
+
+func setCategoryInfo(categoryMembers map[string]categoryInfo, mutex *sync.Mutex, title string, info categoryInfo) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	categoryMembers[title] = info
 }
 
 /*
  * Query Commons for categoryinfo about a bunch of categories.
- * If a category has subcategories, also query for each subcat's categoryinfo
+ * If a category has subcategories, also query for each subcat's categoryinfo.
+ * categoryMembers is shared with sibling calls fanned out over the same
+ * batch, so every read and write goes through getCategoryInfo/setCategoryInfo.
  */
-func queryCommons(categoryMembers map[string]categoryInfo, categoryNames []string, c chan int) {
-	defer close(c)
+func queryCommons(categoryMembers map[string]categoryInfo, categoryNames []string, mutex *sync.Mutex) {
+	var toFetch []string
+	for _, name := range categoryNames {
+		var cached categoryInfo
+		if diskCache.Get(cacheKey("commons-categoryinfo", name), commonsCacheTTL, &cached) {
+			setCategoryInfo(categoryMembers, mutex, name, cached)
+		} else {
+			toFetch = append(toFetch, name)
+		}
+	}
+	if len(toFetch) == 0 {
+		return
+	}
 
-	log.Printf("Querying Commons for %d categories\n", len(categoryNames))
+	log.Printf("Querying Commons for %d categories\n", len(toFetch))
 
 	parameters := params.Values{
 		"action":        "query",
 		"prop":          "categoryinfo",
-		"titles":        strings.Join(categoryNames, "|"),
+		"titles":        strings.Join(toFetch, "|"),
 		"continue":      "",
 		"formatversion": "2",
 	}
 
+	limiter.wait()
+
 	q := commons.NewQuery(parameters)
 	for q.Next() {
 		resp := q.Resp()
@@ -337,26 +731,27 @@ func queryCommons(categoryMembers map[string]categoryInfo, categoryNames []strin
 			title, err := page.GetString("title")
 			check(err)
 
-			thisCategoryInfo := categoryMembers[title]
+			thisCategoryInfo := getCategoryInfo(categoryMembers, mutex, title)
 
 			files, err := page.GetInt64("categoryinfo", "files")
 			if err == nil {
-				thisCategoryInfo.files = int(files)
+				thisCategoryInfo.Files = int(files)
 			} else {
-				thisCategoryInfo.files = 0
+				thisCategoryInfo.Files = 0
 			}
 			subcats, err := page.GetInt64("categoryinfo", "subcats")
 			if err == nil {
-				thisCategoryInfo.subCats = int(subcats)
+				thisCategoryInfo.SubCats = int(subcats)
 			} else {
-				thisCategoryInfo.subCats = 0
+				thisCategoryInfo.SubCats = 0
 			}
 
-			if thisCategoryInfo.subCats > 0 {
-				thisCategoryInfo.subCatsFiles = queryCommonsSubcats(title)
+			if thisCategoryInfo.SubCats > 0 {
+				thisCategoryInfo.SubCatsFiles = queryCommonsSubcats(title)
 			}
 
-			categoryMembers[title] = thisCategoryInfo
+			setCategoryInfo(categoryMembers, mutex, title, thisCategoryInfo)
+			diskCache.Put(cacheKey("commons-categoryinfo", title), thisCategoryInfo)
 		}
 	}
 }
@@ -365,7 +760,12 @@ func queryCommons(categoryMembers map[string]categoryInfo, categoryNames []strin
  * Count files in one's category subcategories.
  */
 func queryCommonsSubcats(categoryName string) int {
-	
+	key := cacheKey("commons-subcats", categoryName)
+	var totalFiles int
+	if diskCache.Get(key, commonsCacheTTL, &totalFiles) {
+		return totalFiles
+	}
+
 	log.Printf("Querying Commons for subcategories of %s\n", categoryName)
 
 	parameters := params.Values{
@@ -378,7 +778,7 @@ func queryCommonsSubcats(categoryName string) int {
 		"formatversion": "2",
 	}
 
-	totalFiles := 0
+	limiter.wait()
 
 	q := commons.NewQuery(parameters)
 
@@ -394,29 +794,49 @@ func queryCommonsSubcats(categoryName string) int {
 		}
 	}
 
+	diskCache.Put(key, totalFiles)
 	return totalFiles
 }
 
-type byOriginalName []specimen
-
-func (a byOriginalName) Len() int { return len(a) }
-func (a byOriginalName) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a byOriginalName) Less(i, j int) bool { return a[i].OriginalName < a[j].OriginalName }
-
 /*
- * Generate a page section by merging the specimens in the provided template.
+ * Generate a page section by merging the specimens in the provided template,
+ * then either reconcile it into the existing wikitext or, with
+ * -force-replace, overwrite it outright.
  */
 func updateWikiPage(specimens chan specimen, c chan int) {
 	defer close(c)
 
+	specimensBuffer := collectSorted(specimens)
+
+	log.Printf("About to update page %s", pageTitle)
+
+	if forceReplace {
+		replaceWikiSection(specimensBuffer)
+		return
+	}
+
+	mergeWikiSection(specimensBuffer)
+}
+
+// collectSorted drains specimens, which arrive incrementally off the
+// pipeline, inserting each one in sorted position right away instead of
+// appending and sorting at the end. Also used by the catalog server to
+// materialize a refreshed snapshot.
+func collectSorted(specimens chan specimen) []specimen {
 	var specimensBuffer []specimen
 	for specimen := range specimens {
+		i := sort.Search(len(specimensBuffer), func(i int) bool {
+			return specimensBuffer[i].OriginalName >= specimen.OriginalName
+		})
 		specimensBuffer = append(specimensBuffer, specimen)
+		copy(specimensBuffer[i+1:], specimensBuffer[i:])
+		specimensBuffer[i] = specimen
 	}
-	sort.Sort(byOriginalName(specimensBuffer))	
-
-	log.Printf("About to update page %s", pageTitle)
+	return specimensBuffer
+}
 
+// renderTable executes the page template against the reconciled specimens.
+func renderTable(specimensBuffer []specimen) string {
 	templateBytes, err := ioutil.ReadFile(templateLocation)
 	check(err)
 
@@ -424,17 +844,274 @@ func updateWikiPage(specimens chan specimen, c chan int) {
 	check(err)
 
 	var buf bytes.Buffer
-
 	tableTemplate.Execute(&buf, specimensBuffer)
+	return buf.String()
+}
 
+// replaceWikiSection is the original behaviour: render the template and
+// clobber the named section with it.
+func replaceWikiSection(specimensBuffer []specimen) {
 	parameters := params.Values{
 		"title":    pageTitle,
 		"section":  sectionNumber,
-		"text":     buf.String(),
+		"text":     renderTable(specimensBuffer),
 		"summary":  "Mise à jour",
 		"notminor": "",
 	}
 
 	e := wiki.Edit(parameters)
 	check(e)
+
+	invalidateCommonsCache(specimensBuffer)
+}
+
+// invalidateCommonsCache drops the cached categoryinfo for every category
+// touched by specimensBuffer once a page edit referencing them has
+// succeeded, so the next run picks up fresh file counts.
+func invalidateCommonsCache(specimensBuffer []specimen) {
+	seen := make(map[string]bool)
+	for _, s := range specimensBuffer {
+		if s.CommonsCategoryName == "" || seen[s.CommonsCategoryName] {
+			continue
+		}
+		seen[s.CommonsCategoryName] = true
+		diskCache.Invalidate(cacheKey("commons-categoryinfo", s.CommonsCategoryName))
+		diskCache.Invalidate(cacheKey("commons-subcats", s.CommonsCategoryName))
+	}
+}
+
+// mergeWikiSection fetches the page's current wikitext, locates the target
+// section's table and reconciles it row by row with the generated
+// specimens, preserving columns the bot doesn't own (e.g. editor-added
+// notes). It only writes back if the reconciled wikitext actually differs.
+func mergeWikiSection(specimensBuffer []specimen) {
+	pageWikitext := fetchWikitext(pageTitle)
+	nodes := wikitext.Parse(wikitext.Tokenize(pageWikitext))
+
+	section := findSection(nodes)
+	if section == nil {
+		log.Fatalf("Could not find section %s on page %s", sectionIdentifier(), pageTitle)
+	}
+
+	table := findTable(section.Children)
+	if table == nil {
+		log.Fatalf("Could not find a table in section %s of page %s", sectionIdentifier(), pageTitle)
+	}
+
+	added, updated, unchanged := reconcileTable(table, specimensBuffer)
+
+	if !table.Dirty {
+		log.Printf("Page %s is already up to date (%d unchanged)", pageTitle, unchanged)
+		return
+	}
+
+	summary := fmt.Sprintf("%d added, %d updated, %d unchanged", added, updated, unchanged)
+
+	parameters := params.Values{
+		"title":    pageTitle,
+		"text":     wikitext.Serialize(nodes),
+		"summary":  summary,
+		"notminor": "",
+	}
+
+	e := wiki.Edit(parameters)
+	check(e)
+
+	invalidateCommonsCache(specimensBuffer)
+
+	log.Printf("Updated page %s: %s", pageTitle, summary)
+}
+
+func sectionIdentifier() string {
+	if sectionAnchor != "" {
+		return sectionAnchor
+	}
+	return sectionNumber
+}
+
+// fetchWikitext retrieves the current wikitext source of a page.
+func fetchWikitext(title string) string {
+	parameters := params.Values{
+		"action":        "parse",
+		"page":          title,
+		"prop":          "wikitext",
+		"formatversion": "2",
+	}
+
+	resp, err := wiki.Get(parameters)
+	check(err)
+
+	text, err := resp.GetString("parse", "wikitext")
+	check(err)
+
+	return text
+}
+
+// findSection locates the section matching -section-anchor when it is set
+// (with no fallback to -s if no heading matches), or otherwise the
+// sectionNumber-th heading in the page (MediaWiki's own 1-based section
+// numbering, counting headings in document order regardless of nesting).
+func findSection(nodes []*wikitext.Node) *wikitext.Node {
+	if sectionAnchor != "" {
+		return findSectionByHeading(nodes, sectionAnchor)
+	}
+
+	number, err := strconv.Atoi(sectionNumber)
+	if err != nil {
+		return findSectionByHeading(nodes, sectionNumber)
+	}
+
+	count := 0
+	var found *wikitext.Node
+	walkSections(nodes, func(s *wikitext.Node) bool {
+		count++
+		if count == number {
+			found = s
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+func findSectionByHeading(nodes []*wikitext.Node, heading string) *wikitext.Node {
+	var found *wikitext.Node
+	walkSections(nodes, func(s *wikitext.Node) bool {
+		if s.Heading == heading {
+			found = s
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// walkSections visits every section node in document order, depth-first,
+// stopping as soon as visit returns false.
+func walkSections(nodes []*wikitext.Node, visit func(*wikitext.Node) bool) bool {
+	for _, n := range nodes {
+		if n.Kind == wikitext.KindSection {
+			if !visit(n) {
+				return false
+			}
+			if !walkSections(n.Children, visit) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// findTable returns the first table found in nodes, descending into
+// sub-sections.
+func findTable(nodes []*wikitext.Node) *wikitext.Node {
+	for _, n := range nodes {
+		if n.Kind == wikitext.KindTable {
+			return n
+		}
+		if n.Kind == wikitext.KindSection {
+			if t := findTable(n.Children); t != nil {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// botOwnedColumns is how many leading table columns the bot generates per
+// specimen, in the order produced by specimenCells. Anything beyond that in
+// an existing row is left untouched, so curators can append their own
+// columns (e.g. notes) without the bot clobbering them.
+const botOwnedColumns = 11
+
+// specimenCells renders one specimen into the cells the bot owns, in the
+// same column order the existing table is expected to use.
+func specimenCells(s specimen) []wikitext.Cell {
+	values := []string{
+		s.AccessionNumber,
+		s.OriginalName,
+		s.VernacularName,
+		s.WikidataItemId,
+		s.CommonsCategoryName,
+		strconv.Itoa(s.FileCount),
+		strconv.Itoa(s.SubCats),
+		strconv.Itoa(s.SubCatsFileCounts),
+		strconv.Itoa(s.TotalFiles),
+		s.Treatment,
+		s.SpecimenCategory,
+	}
+	cells := make([]wikitext.Cell, len(values))
+	for i, v := range values {
+		cells[i] = wikitext.Cell{Text: v}
+	}
+	return cells
+}
+
+// reconcileTable merges the generated specimens into table, matching
+// existing rows by AccessionNumber (the first bot-owned column) and
+// preserving any manually-added columns past botOwnedColumns. It sets
+// table.Dirty only if something actually changed.
+func reconcileTable(table *wikitext.Node, specimensBuffer []specimen) (added, updated, unchanged int) {
+	if len(table.Rows) == 0 {
+		return
+	}
+
+	header := table.Rows[0]
+	existingByAccession := make(map[string]wikitext.Row)
+	for _, row := range table.Rows[1:] {
+		if len(row.Cells) == 0 {
+			continue
+		}
+		existingByAccession[row.Cells[0].Text] = row
+	}
+
+	newRows := []wikitext.Row{header}
+	changed := false
+
+	for _, s := range specimensBuffer {
+		generated := specimenCells(s)
+
+		existing, found := existingByAccession[s.AccessionNumber]
+		if !found {
+			newRows = append(newRows, wikitext.Row{Cells: generated})
+			added++
+			changed = true
+			continue
+		}
+
+		merged, rowChanged := mergeRow(existing, generated)
+		newRows = append(newRows, merged)
+		if rowChanged {
+			updated++
+			changed = true
+		} else {
+			unchanged++
+		}
+	}
+
+	if changed {
+		table.Rows = newRows
+		table.Dirty = true
+	}
+
+	return
+}
+
+// mergeRow overwrites existing's bot-owned cells with generated, keeping any
+// manually-added cells past botOwnedColumns untouched.
+func mergeRow(existing wikitext.Row, generated []wikitext.Cell) (merged wikitext.Row, changed bool) {
+	cells := make([]wikitext.Cell, len(generated))
+	copy(cells, generated)
+
+	for i, cell := range cells {
+		if i >= len(existing.Cells) || existing.Cells[i].Text != cell.Text {
+			changed = true
+		}
+	}
+
+	if len(existing.Cells) > len(generated) {
+		cells = append(cells, existing.Cells[len(generated):]...)
+	}
+
+	return wikitext.Row{Cells: cells}, changed
 }
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2015 Édouard Hue
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/edouardhue/collections/wikitext"
+)
+
+// renderRow reproduces serializeTable's per-cell layout, so the test can
+// build its expected output from the same specimenCells a reconcile would
+// generate instead of hand-copying column values.
+func renderRow(cells []wikitext.Cell) string {
+	var b strings.Builder
+	b.WriteString("|-\n")
+	for _, cell := range cells {
+		if cell.Header {
+			b.WriteString("! ")
+		} else {
+			b.WriteString("| ")
+		}
+		b.WriteString(cell.Text)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// TestReconcileTableSerializesCleanly exercises reconcileTable/mergeRow/
+// specimenCells end to end, then asserts the full Serialize(nodes) output,
+// covering the dirty-serialize path that TestParseTableRoundTripsRawWhenUntouched
+// doesn't: a reconciled table must not pick up a spurious blank line where
+// its rebuilt "|}" meets whatever follows it on the page.
+func TestReconcileTableSerializesCleanly(t *testing.T) {
+	src := "==Specimens==\n" +
+		"{|\n" +
+		"|-\n" +
+		"! Accession\n" +
+		"! Name\n" +
+		"|-\n" +
+		"| A1\n| Old name\n| Common1\n| Q1\n| Cat1\n| 3\n| 0\n| 0\n| 3\n| T1\n| C1\n" +
+		"|-\n" +
+		"| A2\n| Unchanged\n| Common2\n| Q2\n| Cat2\n| 5\n| 1\n| 2\n| 7\n| T2\n| C2\n" +
+		"|}\n" +
+		"Outro\n"
+
+	oldSectionNumber := sectionNumber
+	sectionNumber = "1"
+	defer func() { sectionNumber = oldSectionNumber }()
+
+	nodes := wikitext.Parse(wikitext.Tokenize(src))
+	section := findSection(nodes)
+	if section == nil {
+		t.Fatal("expected to find the Specimens section")
+	}
+	table := findTable(section.Children)
+	if table == nil {
+		t.Fatal("expected to find a table in the Specimens section")
+	}
+	header := table.Rows[0]
+
+	specimens := []specimen{
+		{ // updated: OriginalName changed from the existing row
+			AccessionNumber: "A1", OriginalName: "New name", VernacularName: "Common1",
+			WikidataItemId: "Q1", CommonsCategoryName: "Cat1",
+			FileCount: 3, SubCats: 0, SubCatsFileCounts: 0, TotalFiles: 3,
+			Treatment: "T1", SpecimenCategory: "C1",
+		},
+		{ // unchanged: every bot-owned column matches the existing row
+			AccessionNumber: "A2", OriginalName: "Unchanged", VernacularName: "Common2",
+			WikidataItemId: "Q2", CommonsCategoryName: "Cat2",
+			FileCount: 5, SubCats: 1, SubCatsFileCounts: 2, TotalFiles: 7,
+			Treatment: "T2", SpecimenCategory: "C2",
+		},
+		{AccessionNumber: "A3", OriginalName: "Brand new"}, // added: no existing row
+	}
+
+	added, updated, unchanged := reconcileTable(table, specimens)
+	if added != 1 || updated != 1 || unchanged != 1 {
+		t.Fatalf("got added=%d updated=%d unchanged=%d, want 1/1/1", added, updated, unchanged)
+	}
+	if !table.Dirty {
+		t.Fatal("expected the table to be marked Dirty")
+	}
+
+	var want strings.Builder
+	want.WriteString("==Specimens==\n{|\n")
+	want.WriteString(renderRow(header.Cells))
+	for _, s := range specimens {
+		want.WriteString(renderRow(specimenCells(s)))
+	}
+	want.WriteString("|}\nOutro\n")
+
+	if got := wikitext.Serialize(nodes); got != want.String() {
+		t.Fatalf("got %q, want %q", got, want.String())
+	}
+}
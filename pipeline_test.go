@@ -0,0 +1,58 @@
+/*
+ * Copyright 2015 Édouard Hue
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestCategoryInfoConcurrentAccess exercises the exact access pattern
+// enrichBatch's worker pool uses against a shared categoryInfoMap: many
+// goroutines reading and writing distinct (and occasionally the same) keys
+// through getCategoryInfo/setCategoryInfo. Run with -race, this is the
+// pattern that used to be a concurrent map write before queryCommons took a
+// mutex.
+func TestCategoryInfoConcurrentAccess(t *testing.T) {
+	categoryInfoMap := make(map[string]categoryInfo)
+	var mutex sync.Mutex
+
+	const workers = 16
+	const perWorker = 200
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				// A handful of categories shared across workers, like real
+				// catalogs where several specimens share a Commons category.
+				title := fmt.Sprintf("Category:%d", i%10)
+				info := getCategoryInfo(categoryInfoMap, &mutex, title)
+				info.Files++
+				setCategoryInfo(categoryInfoMap, &mutex, title, info)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(categoryInfoMap) != 10 {
+		t.Fatalf("got %d distinct categories, want 10", len(categoryInfoMap))
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2015 Édouard Hue
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "time"
+
+/*
+ * tokenBucket is a minimal token-bucket rate limiter, used to cap how many
+ * requests per second we issue against Commons/WDQS on cache misses, so the
+ * bot stays within their etiquette limits.
+ */
+type tokenBucket struct {
+	tokens chan struct{}
+}
+
+func newTokenBucket(qps float64) *tokenBucket {
+	if qps <= 0 {
+		qps = 1
+	}
+
+	b := &tokenBucket{tokens: make(chan struct{}, 1)}
+	b.tokens <- struct{}{}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / qps))
+		defer ticker.Stop()
+		for range ticker.C {
+			select {
+			case b.tokens <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return b
+}
+
+// wait blocks until a token is available.
+func (b *tokenBucket) wait() {
+	<-b.tokens
+}
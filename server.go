@@ -0,0 +1,287 @@
+/*
+ * Copyright 2015 Édouard Hue
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// catalog is the in-memory snapshot served by -serve, refreshed on
+// -refresh-interval by running the same pipeline used to edit the wiki.
+type catalog struct {
+	mutex       sync.RWMutex
+	specimens   []specimen
+	byAccession map[string]specimen
+	lastRefresh time.Time
+	lastError   error
+}
+
+func newCatalog() *catalog {
+	return &catalog{}
+}
+
+func (cat *catalog) set(specimens []specimen) {
+	byAccession := make(map[string]specimen, len(specimens))
+	for _, s := range specimens {
+		byAccession[s.AccessionNumber] = s
+	}
+
+	cat.mutex.Lock()
+	defer cat.mutex.Unlock()
+	cat.specimens = specimens
+	cat.byAccession = byAccession
+	cat.lastRefresh = time.Now()
+	cat.lastError = nil
+}
+
+func (cat *catalog) setError(err error) {
+	cat.mutex.Lock()
+	defer cat.mutex.Unlock()
+	cat.lastError = err
+}
+
+func (cat *catalog) all() []specimen {
+	cat.mutex.RLock()
+	defer cat.mutex.RUnlock()
+	return cat.specimens
+}
+
+func (cat *catalog) get(accession string) (specimen, bool) {
+	cat.mutex.RLock()
+	defer cat.mutex.RUnlock()
+	s, ok := cat.byAccession[accession]
+	return s, ok
+}
+
+func (cat *catalog) snapshot() (count int, lastRefresh time.Time, lastError error) {
+	cat.mutex.RLock()
+	defer cat.mutex.RUnlock()
+	return len(cat.specimens), cat.lastRefresh, cat.lastError
+}
+
+// searchFold is a diacritic-insensitive, case-folded transform chain: NFD
+// decomposition, stripping of combining marks, then Unicode case folding.
+var searchFold = transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), cases.Fold())
+
+func foldForSearch(s string) string {
+	folded, _, err := transform.String(searchFold, s)
+	if err != nil {
+		return strings.ToLower(s)
+	}
+	return folded
+}
+
+// catalogPageTemplate renders the reconciled catalog as a plain HTML page
+// for curators browsing "/" directly, as opposed to renderTable's wikitext
+// output meant for the wiki page itself. html/template auto-escapes field
+// values, so specimen data (e.g. a name containing "<" or "&") can't break
+// the page.
+var catalogPageTemplate = template.Must(template.New("catalogPage").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Collections catalog</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.5em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Collections catalog</h1>
+<p>{{len .}} specimens</p>
+<table>
+<thead>
+<tr>
+<th>Accession</th>
+<th>Name</th>
+<th>Vernacular name</th>
+<th>Wikidata item</th>
+<th>Commons category</th>
+<th>Files</th>
+<th>Subcats</th>
+<th>Subcat files</th>
+<th>Total files</th>
+<th>Treatment</th>
+<th>Category</th>
+</tr>
+</thead>
+<tbody>
+{{range .}}<tr>
+<td>{{.AccessionNumber}}</td>
+<td>{{.OriginalName}}</td>
+<td>{{.VernacularName}}</td>
+<td>{{.WikidataItemId}}</td>
+<td>{{.CommonsCategoryName}}</td>
+<td>{{.FileCount}}</td>
+<td>{{.SubCats}}</td>
+<td>{{.SubCatsFileCounts}}</td>
+<td>{{.TotalFiles}}</td>
+<td>{{.Treatment}}</td>
+<td>{{.SpecimenCategory}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+</body>
+</html>
+`))
+
+// renderCatalogPage renders specimens as the HTML page served on "/".
+func renderCatalogPage(specimens []specimen) (string, error) {
+	var buf bytes.Buffer
+	if err := catalogPageTemplate.Execute(&buf, specimens); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// refreshCatalogOnce re-reads the CSV and runs it through the same batch/
+// SPARQL/Commons pipeline queryWdq uses, then swaps it into cat. It returns
+// the first error any pipeline stage hit instead of exiting the process, so
+// a transient SPARQL/Commons/CSV failure only fails this one pass.
+func refreshCatalogOnce(cat *catalog) error {
+	specimens := make(chan specimen, batchSize)
+	readErrs := &firstError{}
+	go func() {
+		defer recoverStage(readErrs)
+		readCsvFile(specimens)
+	}()
+
+	merged, pipelineErrs := runPipeline(specimens)
+	sorted := collectSorted(merged)
+
+	if err := readErrs.get(); err != nil {
+		return err
+	}
+	if err := pipelineErrs.get(); err != nil {
+		return err
+	}
+
+	cat.set(sorted)
+	return nil
+}
+
+// refreshCatalogLoop refreshes cat every -refresh-interval, recovering from
+// a failed pass instead of bringing the server down: refreshCatalogOnce
+// reports pipeline-stage failures (check() panics under -serve instead of
+// exiting) as a plain error, and the recover below is a last-resort net for
+// anything that panics directly in this goroutine instead.
+func refreshCatalogLoop(cat *catalog) {
+	for {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Catalog refresh failed: %v", r)
+					cat.setError(fmt.Errorf("%v", r))
+				}
+			}()
+			log.Println("Refreshing catalog")
+			if err := refreshCatalogOnce(cat); err != nil {
+				log.Printf("Catalog refresh failed: %v", err)
+				cat.setError(err)
+				return
+			}
+			log.Println("Catalog refreshed")
+		}()
+		time.Sleep(refreshInterval)
+	}
+}
+
+// serveCatalog starts the background refresh loop and blocks serving the
+// reconciled catalog over HTTP, as an alternative to editing the wiki.
+func serveCatalog() {
+	cat := newCatalog()
+	go refreshCatalogLoop(cat)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/specimens", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, cat.all())
+	})
+	mux.HandleFunc("/specimens/", func(w http.ResponseWriter, r *http.Request) {
+		accession := strings.TrimPrefix(r.URL.Path, "/specimens/")
+		s, ok := cat.get(accession)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, s)
+	})
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		needle := foldForSearch(r.URL.Query().Get("q"))
+		var matches []specimen
+		for _, s := range cat.all() {
+			if needle == "" || strings.Contains(foldForSearch(s.OriginalName), needle) ||
+				strings.Contains(foldForSearch(s.VernacularName), needle) {
+				matches = append(matches, s)
+			}
+		}
+		writeJSON(w, matches)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _, lastError := cat.snapshot()
+		if lastError != nil {
+			http.Error(w, lastError.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		count, lastRefresh, lastError := cat.snapshot()
+		fmt.Fprintf(w, "collections_specimens_total %d\n", count)
+		fmt.Fprintf(w, "collections_last_refresh_timestamp_seconds %d\n", lastRefresh.Unix())
+		errored := 0
+		if lastError != nil {
+			errored = 1
+		}
+		fmt.Fprintf(w, "collections_last_refresh_errored %d\n", errored)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		page, err := renderCatalogPage(cat.all())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, page)
+	})
+
+	log.Printf("Serving catalog on %s\n", serveAddr)
+	check(http.ListenAndServe(serveAddr, mux))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	check(json.NewEncoder(w).Encode(v))
+}
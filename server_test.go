@@ -0,0 +1,82 @@
+/*
+ * Copyright 2015 Édouard Hue
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCatalogSetAndGet(t *testing.T) {
+	cat := newCatalog()
+	cat.set([]specimen{
+		{AccessionNumber: "A1", OriginalName: "Panthera leo"},
+		{AccessionNumber: "A2", OriginalName: "Panthera tigris"},
+	})
+
+	if got, ok := cat.get("A1"); !ok || got.OriginalName != "Panthera leo" {
+		t.Fatalf("got %+v, %v, want Panthera leo, true", got, ok)
+	}
+	if _, ok := cat.get("missing"); ok {
+		t.Fatal("expected a miss for an unknown accession")
+	}
+
+	count, _, lastError := cat.snapshot()
+	if count != 2 {
+		t.Fatalf("got count %d, want 2", count)
+	}
+	if lastError != nil {
+		t.Fatalf("got lastError %v, want nil", lastError)
+	}
+}
+
+func TestCatalogSetClearsPriorError(t *testing.T) {
+	cat := newCatalog()
+	cat.setError(errors.New("boom"))
+
+	if _, _, lastError := cat.snapshot(); lastError == nil {
+		t.Fatal("expected setError to be visible before the next set")
+	}
+
+	cat.set([]specimen{{AccessionNumber: "A1"}})
+
+	if _, _, lastError := cat.snapshot(); lastError != nil {
+		t.Fatalf("got lastError %v, want nil after a successful set", lastError)
+	}
+}
+
+func TestFoldForSearchIgnoresCaseAndDiacritics(t *testing.T) {
+	if got := foldForSearch("Éléphant"); got != "elephant" {
+		t.Fatalf("got %q, want %q", got, "elephant")
+	}
+}
+
+func TestRenderCatalogPageEscapesContent(t *testing.T) {
+	page, err := renderCatalogPage([]specimen{
+		{AccessionNumber: "A1", OriginalName: "<script>alert(1)</script>"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(page, "<script>alert(1)</script>") {
+		t.Fatal("expected specimen content to be HTML-escaped, found it raw in the page")
+	}
+	if !strings.Contains(page, "A1") {
+		t.Fatal("expected the rendered page to contain the specimen's accession number")
+	}
+}
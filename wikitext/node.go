@@ -0,0 +1,299 @@
+/*
+ * Copyright 2015 Édouard Hue
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wikitext
+
+import "strings"
+
+// Node kinds share the Kind type with token kinds; KindText doubles as both
+// the token for a run of plain text and the node built from it.
+const (
+	KindTemplate Kind = iota + 100
+	KindLink
+	KindTable
+	KindSection
+)
+
+// Node is one element of a parsed page: plain text, a template or link call,
+// a table, or a section introduced by a heading. Raw always holds the exact
+// source bytes the node was parsed from, which is what lets Serialize
+// reproduce an untouched node byte-for-byte.
+type Node struct {
+	Kind Kind
+	Raw  string
+
+	// Template and Link
+	Name string
+
+	// Section
+	Level       int
+	Heading     string
+	HeadingLine string
+	Children    []*Node
+
+	// Table
+	OpenLine string
+	Rows     []Row
+	Dirty    bool
+}
+
+// Row is one row of a table, either the header row or a data row.
+type Row struct {
+	Cells []Cell
+}
+
+// Cell is one cell of a table row. Text is the trimmed cell content used for
+// reconciliation; it does not participate in round-tripping an unmodified
+// table, which is serialized from Node.Raw instead.
+type Cell struct {
+	Header bool
+	Text   string
+}
+
+type parser struct {
+	tokens []Token
+	pos    int
+}
+
+// Parse builds a tree of Nodes out of a token stream produced by Tokenize.
+func Parse(tokens []Token) []*Node {
+	p := &parser{tokens: tokens}
+	nodes, _ := p.parseSequence(0)
+	return nodes
+}
+
+// parseSequence consumes tokens until it meets a heading whose level is <=
+// minLevel (the enclosing section has ended) or EOF, and returns the parsed
+// nodes together with the index of the first unconsumed token.
+func (p *parser) parseSequence(minLevel int) ([]*Node, int) {
+	var nodes []*Node
+	var text strings.Builder
+
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, &Node{Kind: KindText, Raw: text.String()})
+			text.Reset()
+		}
+	}
+
+	for p.pos < len(p.tokens) {
+		tok := p.tokens[p.pos]
+		switch tok.Kind {
+		case KindEOF:
+			flush()
+			return nodes, p.pos
+		case KindHeading:
+			if minLevel != 0 && tok.Level <= minLevel {
+				flush()
+				return nodes, p.pos
+			}
+			flush()
+			nodes = append(nodes, p.parseSection(tok))
+		case KindTableOpen:
+			flush()
+			nodes = append(nodes, p.parseTable())
+		case KindTemplateOpen:
+			flush()
+			nodes = append(nodes, p.parseBalanced(KindTemplateOpen, KindTemplateClose, KindTemplate))
+		case KindLinkOpen:
+			flush()
+			nodes = append(nodes, p.parseBalanced(KindLinkOpen, KindLinkClose, KindLink))
+		default:
+			text.WriteString(tok.Text)
+			p.pos++
+		}
+	}
+
+	flush()
+	return nodes, p.pos
+}
+
+func (p *parser) parseSection(heading Token) *Node {
+	p.pos++ // consume the heading token itself
+	children, _ := p.parseSequence(heading.Level)
+
+	var raw strings.Builder
+	raw.WriteString(heading.Text)
+	for _, c := range children {
+		raw.WriteString(c.Raw)
+	}
+
+	return &Node{
+		Kind:        KindSection,
+		Raw:         raw.String(),
+		Level:       heading.Level,
+		Heading:     heading.Heading,
+		HeadingLine: heading.Text,
+		Children:    children,
+	}
+}
+
+// parseBalanced captures a template ({{...}}) or link ([[...]]) span as a
+// single opaque node, tracking nesting depth. Name holds the template name or
+// link target (the text before the first top-level pipe).
+func (p *parser) parseBalanced(open, closeKind Kind, nodeKind Kind) *Node {
+	var raw strings.Builder
+	var name strings.Builder
+	raw.WriteString(p.tokens[p.pos].Text)
+	p.pos++
+
+	depth := 1
+	sawPipe := false
+	for p.pos < len(p.tokens) && depth > 0 {
+		tok := p.tokens[p.pos]
+		switch tok.Kind {
+		case open:
+			depth++
+			raw.WriteString(tok.Text)
+		case closeKind:
+			depth--
+			raw.WriteString(tok.Text)
+		case KindPipe:
+			if depth == 1 {
+				sawPipe = true
+			}
+			raw.WriteString(tok.Text)
+		case KindEOF:
+			depth = 0
+			continue
+		default:
+			raw.WriteString(tok.Text)
+			if depth == 1 && !sawPipe {
+				name.WriteString(tok.Text)
+			}
+		}
+		p.pos++
+	}
+
+	return &Node{Kind: nodeKind, Raw: raw.String(), Name: strings.TrimSpace(name.String())}
+}
+
+// parseTable captures a {| ... |} block, splitting it into rows and cells so
+// callers can reconcile generated rows against existing ones.
+func (p *parser) parseTable() *Node {
+	var raw strings.Builder
+	raw.WriteString(p.tokens[p.pos].Text) // "{|"
+	p.pos++
+
+	var rows []Row
+	var curRow *Row
+	var curCell *Cell
+	var cellText strings.Builder
+	// sawAttrSep tracks whether the single '|' (or '!') separating an
+	// attribute list from the cell's content has already been consumed for
+	// curCell, so a later one -- there shouldn't be one in valid wikitext,
+	// but be lenient -- starts a new cell instead of being swallowed again.
+	var sawAttrSep bool
+
+	flushCell := func() {
+		if curCell != nil {
+			curCell.Text = strings.TrimSpace(cellText.String())
+			curRow.Cells = append(curRow.Cells, *curCell)
+			curCell = nil
+		}
+		cellText.Reset()
+		sawAttrSep = false
+	}
+	flushRow := func() {
+		flushCell()
+		if curRow != nil {
+			rows = append(rows, *curRow)
+			curRow = nil
+		}
+	}
+	startCell := func(header bool) {
+		flushCell()
+		if curRow == nil {
+			curRow = &Row{}
+		}
+		curCell = &Cell{Header: header}
+	}
+
+	finish := func() *Node {
+		tableRaw := raw.String()
+		openLine := tableRaw
+		if idx := strings.IndexByte(tableRaw, '\n'); idx >= 0 {
+			openLine = tableRaw[:idx+1]
+		}
+		return &Node{Kind: KindTable, Raw: tableRaw, OpenLine: openLine, Rows: rows}
+	}
+
+	for p.pos < len(p.tokens) {
+		tok := p.tokens[p.pos]
+		switch tok.Kind {
+		case KindTableClose:
+			raw.WriteString(tok.Text)
+			p.pos++
+			flushRow()
+			return finish()
+		case KindTableRowSep:
+			raw.WriteString(tok.Text)
+			flushRow()
+			p.pos++
+		case KindPipe:
+			raw.WriteString(tok.Text)
+			switch {
+			case tok.AtLineStart:
+				startCell(false)
+			case tok.Text == "||":
+				if curCell != nil {
+					startCell(curCell.Header)
+				} else {
+					cellText.WriteString(tok.Text)
+				}
+			case curCell != nil && !sawAttrSep:
+				// The first bare '|' on a cell's own line separates its
+				// attribute list from its content, e.g. `| style="x" | text`;
+				// it is not a new cell boundary.
+				sawAttrSep = true
+				cellText.Reset()
+			case curCell != nil:
+				startCell(curCell.Header)
+			default:
+				cellText.WriteString(tok.Text)
+			}
+			p.pos++
+		case KindBang:
+			raw.WriteString(tok.Text)
+			switch {
+			case tok.AtLineStart:
+				startCell(true)
+			case curCell == nil || !curCell.Header:
+				cellText.WriteString(tok.Text)
+			case tok.Text == "!!":
+				startCell(true)
+			case !sawAttrSep:
+				sawAttrSep = true
+				cellText.Reset()
+			default:
+				startCell(true)
+			}
+			p.pos++
+		case KindEOF:
+			flushRow()
+			return finish()
+		default:
+			raw.WriteString(tok.Text)
+			if curCell != nil {
+				cellText.WriteString(tok.Text)
+			}
+			p.pos++
+		}
+	}
+
+	flushRow()
+	return finish()
+}
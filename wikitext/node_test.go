@@ -0,0 +1,110 @@
+/*
+ * Copyright 2015 Édouard Hue
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wikitext
+
+import (
+	"strings"
+	"testing"
+)
+
+func parseOneTable(t *testing.T, src string) *Node {
+	t.Helper()
+	nodes := Parse(Tokenize(src))
+	for _, n := range nodes {
+		if n.Kind == KindTable {
+			return n
+		}
+	}
+	t.Fatalf("no table found in %q", src)
+	return nil
+}
+
+func TestParseTableUnattributedCells(t *testing.T) {
+	table := parseOneTable(t, "{|\n|-\n| foo || bar\n|}\n")
+
+	if len(table.Rows) != 1 {
+		t.Fatalf("got %d rows, want 1", len(table.Rows))
+	}
+	row := table.Rows[0]
+	if len(row.Cells) != 2 {
+		t.Fatalf("got %d cells, want 2: %+v", len(row.Cells), row.Cells)
+	}
+	if row.Cells[0].Text != "foo" || row.Cells[1].Text != "bar" {
+		t.Fatalf("unexpected cell texts: %+v", row.Cells)
+	}
+}
+
+func TestParseTableAttributedCell(t *testing.T) {
+	table := parseOneTable(t, `{|
+|-
+| style="color:red" | Some note || plain
+|}
+`)
+
+	if len(table.Rows) != 1 {
+		t.Fatalf("got %d rows, want 1", len(table.Rows))
+	}
+	row := table.Rows[0]
+	if len(row.Cells) != 2 {
+		t.Fatalf("got %d cells, want 2 (attribute cell split into an extra cell): %+v", len(row.Cells), row.Cells)
+	}
+	if row.Cells[0].Text != "Some note" {
+		t.Fatalf("got cell[0].Text %q, want %q", row.Cells[0].Text, "Some note")
+	}
+	if row.Cells[1].Text != "plain" {
+		t.Fatalf("got cell[1].Text %q, want %q", row.Cells[1].Text, "plain")
+	}
+}
+
+func TestParseTableAttributedHeaderCell(t *testing.T) {
+	table := parseOneTable(t, `{|
+|-
+! scope="row" | Accession
+! Name
+|}
+`)
+
+	if len(table.Rows) != 1 {
+		t.Fatalf("got %d rows, want 1", len(table.Rows))
+	}
+	row := table.Rows[0]
+	if len(row.Cells) != 2 {
+		t.Fatalf("got %d cells, want 2: %+v", len(row.Cells), row.Cells)
+	}
+	if !row.Cells[0].Header || row.Cells[0].Text != "Accession" {
+		t.Fatalf("unexpected cell[0]: %+v", row.Cells[0])
+	}
+	if !row.Cells[1].Header || row.Cells[1].Text != "Name" {
+		t.Fatalf("unexpected cell[1]: %+v", row.Cells[1])
+	}
+}
+
+// TestParseTableRoundTripsRawWhenUntouched checks table.Raw against the
+// source up to "|}": the newline that follows it belongs to the next
+// sibling Text node, not the table, so a full Parse+Serialize round trip
+// still reproduces src exactly even though this single node's Raw doesn't.
+func TestParseTableRoundTripsRawWhenUntouched(t *testing.T) {
+	src := "{|\n|-\n| style=\"color:red\" | Some note || plain\n|}\n"
+	table := parseOneTable(t, src)
+	want := strings.TrimSuffix(src, "\n")
+	if table.Raw != want {
+		t.Fatalf("got Raw %q, want %q", table.Raw, want)
+	}
+	if got := Serialize(Parse(Tokenize(src))); got != src {
+		t.Fatalf("got full round trip %q, want %q", got, src)
+	}
+}
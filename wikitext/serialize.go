@@ -0,0 +1,71 @@
+/*
+ * Copyright 2015 Édouard Hue
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wikitext
+
+import "strings"
+
+// Serialize turns a parsed tree back into wikitext. Nodes that were never
+// touched after parsing serialize to their original Raw bytes; only a table
+// whose Rows were reconciled (Dirty) is rebuilt from its structured fields.
+func Serialize(nodes []*Node) string {
+	var b strings.Builder
+	for _, n := range nodes {
+		b.WriteString(serializeNode(n))
+	}
+	return b.String()
+}
+
+func serializeNode(n *Node) string {
+	switch n.Kind {
+	case KindSection:
+		var b strings.Builder
+		b.WriteString(n.HeadingLine)
+		for _, c := range n.Children {
+			b.WriteString(serializeNode(c))
+		}
+		return b.String()
+	case KindTable:
+		if !n.Dirty {
+			return n.Raw
+		}
+		return serializeTable(n)
+	default:
+		return n.Raw
+	}
+}
+
+func serializeTable(n *Node) string {
+	var b strings.Builder
+	b.WriteString(n.OpenLine)
+	for _, row := range n.Rows {
+		b.WriteString("|-\n")
+		for _, cell := range row.Cells {
+			if cell.Header {
+				b.WriteString("! ")
+			} else {
+				b.WriteString("| ")
+			}
+			b.WriteString(cell.Text)
+			b.WriteString("\n")
+		}
+	}
+	// No trailing newline here: parseTable never consumes the newline after
+	// "|}" into Raw (it's left for the next sibling Text node), so adding one
+	// here would double it up on an actual reconcile.
+	b.WriteString("|}")
+	return b.String()
+}
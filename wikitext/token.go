@@ -0,0 +1,215 @@
+/*
+ * Copyright 2015 Édouard Hue
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package wikitext implements just enough of MediaWiki's wikitext syntax to
+// let the bot merge generated content into a page section instead of
+// overwriting it: a tokenizer, a tree parser and a serializer that round-trips
+// anything it doesn't understand byte-for-byte.
+package wikitext
+
+import (
+	"regexp"
+	"strings"
+)
+
+type Kind int
+
+const (
+	KindText Kind = iota
+	KindComment
+	KindHeading
+	KindTemplateOpen
+	KindTemplateClose
+	KindLinkOpen
+	KindLinkClose
+	KindTableOpen
+	KindTableClose
+	KindTableRowSep
+	KindPipe
+	KindBang
+	KindEquals
+	KindEOF
+)
+
+// Token is a single lexical unit. Text always holds the exact source bytes it
+// covers, so concatenating every token's Text reproduces the input exactly.
+type Token struct {
+	Kind        Kind
+	Text        string
+	Heading     string // trimmed heading title, set only for KindHeading
+	Level       int    // heading level (number of '='), set only for KindHeading
+	AtLineStart bool   // true when this token is the first thing on its line
+}
+
+// RE2 has no backreferences, so the closing run of '=' is matched generically
+// and checked against the opening run's length in matchHeading.
+var headingRe = regexp.MustCompile(`^(={1,6})(.*?)(={1,6})\s*\n?$`)
+
+func matchHeading(m []string) (level int, title string, ok bool) {
+	if m == nil || len(m[1]) != len(m[3]) {
+		return 0, "", false
+	}
+	return len(m[1]), strings.TrimSpace(m[2]), true
+}
+
+// Tokenize turns raw wikitext into a flat token stream. Table and heading
+// markers are only recognised at the start of a line, matching wikitext's own
+// rules; everything else is recognised wherever it appears.
+func Tokenize(src string) []Token {
+	var tokens []Token
+	atLineStart := true
+	i := 0
+	n := len(src)
+
+	for i < n {
+		if strings.HasPrefix(src[i:], "<!--") {
+			end := strings.Index(src[i:], "-->")
+			var text string
+			if end == -1 {
+				text = src[i:]
+			} else {
+				text = src[i : i+end+3]
+			}
+			tokens = append(tokens, Token{Kind: KindComment, Text: text, AtLineStart: atLineStart})
+			i += len(text)
+			atLineStart = false
+			continue
+		}
+
+		if atLineStart && src[i] == '=' {
+			lineEnd := strings.IndexByte(src[i:], '\n')
+			var line string
+			if lineEnd == -1 {
+				line = src[i:]
+			} else {
+				line = src[i : i+lineEnd+1]
+			}
+			if level, title, ok := matchHeading(headingRe.FindStringSubmatch(line)); ok {
+				tokens = append(tokens, Token{
+					Kind:        KindHeading,
+					Text:        line,
+					Heading:     title,
+					Level:       level,
+					AtLineStart: true,
+				})
+				i += len(line)
+				atLineStart = true
+				continue
+			}
+		}
+
+		if atLineStart && strings.HasPrefix(src[i:], "{|") {
+			tokens = append(tokens, Token{Kind: KindTableOpen, Text: "{|", AtLineStart: true})
+			i += 2
+			atLineStart = false
+			continue
+		}
+		if atLineStart && strings.HasPrefix(src[i:], "|}") {
+			tokens = append(tokens, Token{Kind: KindTableClose, Text: "|}", AtLineStart: true})
+			i += 2
+			atLineStart = false
+			continue
+		}
+		if atLineStart && strings.HasPrefix(src[i:], "|-") {
+			tokens = append(tokens, Token{Kind: KindTableRowSep, Text: "|-", AtLineStart: true})
+			i += 2
+			atLineStart = false
+			continue
+		}
+		if strings.HasPrefix(src[i:], "{{") {
+			tokens = append(tokens, Token{Kind: KindTemplateOpen, Text: "{{", AtLineStart: atLineStart})
+			i += 2
+			atLineStart = false
+			continue
+		}
+		if strings.HasPrefix(src[i:], "}}") {
+			tokens = append(tokens, Token{Kind: KindTemplateClose, Text: "}}", AtLineStart: atLineStart})
+			i += 2
+			atLineStart = false
+			continue
+		}
+		if strings.HasPrefix(src[i:], "[[") {
+			tokens = append(tokens, Token{Kind: KindLinkOpen, Text: "[[", AtLineStart: atLineStart})
+			i += 2
+			atLineStart = false
+			continue
+		}
+		if strings.HasPrefix(src[i:], "]]") {
+			tokens = append(tokens, Token{Kind: KindLinkClose, Text: "]]", AtLineStart: atLineStart})
+			i += 2
+			atLineStart = false
+			continue
+		}
+		// "||" and "!!" are single inline cell separators, not two markers back to back.
+		if strings.HasPrefix(src[i:], "||") {
+			tokens = append(tokens, Token{Kind: KindPipe, Text: "||", AtLineStart: atLineStart})
+			i += 2
+			atLineStart = false
+			continue
+		}
+		if strings.HasPrefix(src[i:], "!!") {
+			tokens = append(tokens, Token{Kind: KindBang, Text: "!!", AtLineStart: atLineStart})
+			i += 2
+			atLineStart = false
+			continue
+		}
+		if src[i] == '|' {
+			tokens = append(tokens, Token{Kind: KindPipe, Text: "|", AtLineStart: atLineStart})
+			i++
+			atLineStart = false
+			continue
+		}
+		if src[i] == '!' {
+			tokens = append(tokens, Token{Kind: KindBang, Text: "!", AtLineStart: atLineStart})
+			i++
+			atLineStart = false
+			continue
+		}
+		if src[i] == '=' {
+			tokens = append(tokens, Token{Kind: KindEquals, Text: "=", AtLineStart: atLineStart})
+			i++
+			atLineStart = false
+			continue
+		}
+
+		// Plain text run: everything up to the next marker or end of line.
+		start := i
+		for i < n {
+			c := src[i]
+			if c == '\n' {
+				i++
+				atLineStart = true
+				break
+			}
+			if c == '|' || c == '!' || c == '=' {
+				break
+			}
+			if strings.HasPrefix(src[i:], "{{") || strings.HasPrefix(src[i:], "}}") ||
+				strings.HasPrefix(src[i:], "[[") || strings.HasPrefix(src[i:], "]]") ||
+				strings.HasPrefix(src[i:], "<!--") {
+				break
+			}
+			i++
+			atLineStart = false
+		}
+		if i > start {
+			tokens = append(tokens, Token{Kind: KindText, Text: src[start:i]})
+		}
+	}
+
+	tokens = append(tokens, Token{Kind: KindEOF})
+	return tokens
+}